@@ -0,0 +1,111 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidateAttributes checks that all the requiredKeys are present in the
+// provided attributes. The returned error lists every missing key.
+func (ps *PubSub) ValidateAttributes(attributes map[string]string, requiredKeys []string) error {
+	var missing []string
+	for _, key := range requiredKeys {
+		if _, ok := attributes[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("xk6-pubsub: missing required attributes: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// NormalizeAttributes lowercases all the attribute keys. When several keys
+// become the same after lowercasing, only one of them is kept: a key that was
+// already lowercase wins, otherwise the alphabetically first one. The
+// normalized attributes are returned together with the original keys that
+// were dropped, sorted alphabetically.
+func (ps *PubSub) NormalizeAttributes(attributes map[string]string) (map[string]string, []string) {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		aLower, bLower := a == strings.ToLower(a), b == strings.ToLower(b)
+		if aLower != bLower {
+			return aLower
+		}
+		return a < b
+	})
+
+	normalized := make(map[string]string, len(attributes))
+	dropped := []string{}
+	for _, key := range keys {
+		lower := strings.ToLower(key)
+		if _, ok := normalized[lower]; ok {
+			dropped = append(dropped, key)
+			continue
+		}
+		normalized[lower] = attributes[key]
+	}
+
+	sort.Strings(dropped)
+
+	return normalized, dropped
+}
+
+// JSONToAttributes converts a JSON object to message attributes. Every
+// top-level field of the object must be a string; the returned error lists
+// the fields holding any other value.
+func (ps *PubSub) JSONToAttributes(jsonString string) (map[string]string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonString), &fields); err != nil {
+		return nil, fmt.Errorf("xk6-pubsub: attributes must be a JSON object: %w", err)
+	}
+	if fields == nil {
+		return nil, errors.New("xk6-pubsub: attributes must be a JSON object, got null")
+	}
+
+	attributes := make(map[string]string, len(fields))
+	var invalid []string
+	for key, value := range fields {
+		str, ok := value.(string)
+		if !ok {
+			invalid = append(invalid, fmt.Sprintf("%s (%s)", key, jsonType(value)))
+			continue
+		}
+		attributes[key] = str
+	}
+
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return nil, fmt.Errorf("xk6-pubsub: attribute values must be strings: %s", strings.Join(invalid, ", "))
+	}
+
+	return attributes, nil
+}
+
+// jsonType returns the JSON type name of a value decoded by encoding/json.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
@@ -0,0 +1,199 @@
+package pubsub
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// memorySampleInterval is how often BenchmarkWithResources samples heap usage.
+const memorySampleInterval = 100 * time.Millisecond
+
+// BenchmarkWithResources publishes totalMessages messages of messageSizeBytes
+// bytes to the provided topic from concurrency goroutines and reports the
+// achieved throughput together with the resources used by the k6 process
+// during the run. The middlewares registered with UsePublishMiddleware are not
+// applied, as they cannot run on the publishing goroutines.
+//
+// The returned map contains throughput_msg_per_sec (successful publishes only),
+// avg_memory_mb and peak_memory_mb (heap in use, sampled while publishing),
+// cpu_seconds (user and system CPU time consumed by the process) and errors
+// (the number of failed publishes). An error is returned if totalMessages or
+// messageSizeBytes is negative.
+func (ps *PubSub) BenchmarkWithResources(p *PublisherClient, topic string, concurrency, totalMessages, messageSizeBytes int) (map[string]interface{}, error) {
+	if totalMessages < 0 {
+		return nil, fmt.Errorf("xk6-pubsub: totalMessages must not be negative, got %d", totalMessages)
+	}
+	if messageSizeBytes < 0 {
+		return nil, fmt.Errorf("xk6-pubsub: messageSizeBytes must not be negative, got %d", messageSizeBytes)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	payload := bytes.Repeat([]byte("x"), messageSizeBytes)
+	ctx := ps.vu.Context()
+	state := ps.vu.State()
+
+	var claimed, published, failed int64
+
+	sampler := newMemorySampler()
+	cpuStart := processCPUTime()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&claimed, 1) <= int64(totalMessages) {
+				newMessage := message.NewMessage(watermill.NewShortUUID(), payload)
+				err := publishMessageWith(ctx, p, topic, newMessage, state, publishOptions{skipMiddlewares: true})
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				atomic.AddInt64(&published, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	cpuSeconds := (processCPUTime() - cpuStart).Seconds()
+	avgMemory, peakMemory := sampler.stop()
+
+	throughput := 0.0
+	if elapsed > 0 {
+		throughput = float64(published) / elapsed.Seconds()
+	}
+
+	return map[string]interface{}{
+		"throughput_msg_per_sec": throughput,
+		"avg_memory_mb":          avgMemory,
+		"peak_memory_mb":         peakMemory,
+		"cpu_seconds":            cpuSeconds,
+		"errors":                 failed,
+	}, nil
+}
+
+// AssertPublishSLO publishes msg iterations times in a row using the function
+// publishMessage and measures the duration of every publish. It returns the
+// min, avg, p50, p95, p99 and max durations in milliseconds, and an error if
+// the p99 duration exceeds p99ThresholdMs. It stops at the first failed
+// publish.
+func (ps *PubSub) AssertPublishSLO(p *PublisherClient, topic, msg string, iterations int, p99ThresholdMs float64) (map[string]float64, error) {
+	if iterations < 1 {
+		return nil, fmt.Errorf("xk6-pubsub: iterations must be positive, got %d", iterations)
+	}
+
+	durations := make([]float64, 0, iterations)
+	for i := 0; i < iterations; i++ {
+		newMessage := message.NewMessage(watermill.NewShortUUID(), []byte(msg))
+
+		start := time.Now()
+		if err := publishMessage(ps.vu.Context(), p, topic, newMessage, ps.vu.State()); err != nil {
+			return nil, err
+		}
+		durations = append(durations, float64(time.Since(start))/float64(time.Millisecond))
+	}
+
+	sort.Float64s(durations)
+
+	total := 0.0
+	for _, d := range durations {
+		total += d
+	}
+
+	stats := map[string]float64{
+		"min": durations[0],
+		"avg": total / float64(len(durations)),
+		"p50": percentile(durations, 50),
+		"p95": percentile(durations, 95),
+		"p99": percentile(durations, 99),
+		"max": durations[len(durations)-1],
+	}
+
+	if stats["p99"] > p99ThresholdMs {
+		return stats, fmt.Errorf("xk6-pubsub: p99 publish latency %.2fms exceeds the %.2fms threshold", stats["p99"], p99ThresholdMs)
+	}
+
+	return stats, nil
+}
+
+// percentile returns the nearest-rank percentile of the sorted values.
+func percentile(sorted []float64, pct float64) float64 {
+	rank := int(math.Ceil(pct / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+// memorySampler periodically reads runtime.MemStats in the background and
+// keeps track of the average and peak heap usage.
+type memorySampler struct {
+	done    chan struct{}
+	stopped chan struct{}
+
+	samples int
+	total   uint64
+	peak    uint64
+}
+
+// newMemorySampler starts a memorySampler. It must be stopped with stop.
+func newMemorySampler() *memorySampler {
+	s := &memorySampler{
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.stopped)
+
+		ticker := time.NewTicker(memorySampleInterval)
+		defer ticker.Stop()
+
+		s.sample()
+		for {
+			select {
+			case <-ticker.C:
+				s.sample()
+			case <-s.done:
+				s.sample()
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *memorySampler) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	s.samples++
+	s.total += stats.HeapAlloc
+	if stats.HeapAlloc > s.peak {
+		s.peak = stats.HeapAlloc
+	}
+}
+
+// stop stops the sampling and returns the average and peak heap usage in MB.
+func (s *memorySampler) stop() (float64, float64) {
+	close(s.done)
+	<-s.stopped
+
+	const mb = 1024 * 1024
+	return float64(s.total) / float64(s.samples) / mb, float64(s.peak) / mb
+}
@@ -0,0 +1,96 @@
+package pubsub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// minCachePruneSize is the number of entries a publishCache holds before it
+// starts removing expired entries.
+const minCachePruneSize = 1000
+
+// publishCache remembers the UUIDs of recently published messages by the
+// hash of their topic and data. It is safe for concurrent use.
+type publishCache struct {
+	mu        sync.Mutex
+	entries   map[string]cacheEntry
+	pruneSize int
+}
+
+type cacheEntry struct {
+	uuid    string
+	expires time.Time
+}
+
+func newPublishCache() *publishCache {
+	return &publishCache{
+		entries:   map[string]cacheEntry{},
+		pruneSize: minCachePruneSize,
+	}
+}
+
+// get returns the UUID cached under key if it did not expire yet.
+func (c *publishCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+
+	return entry.uuid, true
+}
+
+// set caches uuid under key for ttl.
+func (c *publishCache) set(key, uuid string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.entries[key] = cacheEntry{uuid: uuid, expires: now.Add(ttl)}
+
+	if len(c.entries) < c.pruneSize {
+		return
+	}
+
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.pruneSize = 2 * len(c.entries)
+	if c.pruneSize < minCachePruneSize {
+		c.pruneSize = minCachePruneSize
+	}
+}
+
+// CachedPublish publishes a message using the function publishMessage unless
+// the same msg was already published to the same topic with the
+// PublisherClient during the last cacheTTLMs milliseconds. Messages are
+// identified by the SHA-256 of the topic and msg joined by a NUL byte. The UUID of the published
+// message is returned together with whether it was taken from the cache.
+func (ps *PubSub) CachedPublish(p *PublisherClient, topic, msg string, cacheTTLMs int) (string, bool, error) {
+	// Topic names cannot contain NUL, so the separator keeps e.g. topic "ab"
+	// with msg "c" apart from topic "a" with msg "bc".
+	sum := sha256.Sum256([]byte(topic + "\x00" + msg))
+	key := hex.EncodeToString(sum[:])
+
+	if uuid, ok := p.cache.get(key); ok {
+		return uuid, true, nil
+	}
+
+	newMessage := message.NewMessage(watermill.NewShortUUID(), []byte(msg))
+	if err := publishMessage(ps.vu.Context(), p, topic, newMessage, ps.vu.State()); err != nil {
+		return "", false, err
+	}
+	p.cache.set(key, newMessage.UUID, time.Duration(cacheTTLMs)*time.Millisecond)
+
+	return newMessage.UUID, false, nil
+}
@@ -0,0 +1,63 @@
+package pubsub
+
+import "math"
+
+// Pub/Sub throughput pricing used by ThroughputCapacity.
+// See https://cloud.google.com/pubsub/pricing
+const (
+	pricePerTiBUSD  = 40.0
+	bytesPerTiB     = 1 << 40
+	secondsPerMonth = 30 * 24 * 60 * 60
+)
+
+// BatchingCostAnalysis estimates how much batching saves when publishing
+// totalMessages messages. Pub/Sub bills every publish request for at least
+// 1000 bytes, so small messages published one per request are each billed at
+// that minimum; singleMessageCostUSD is the cost of such a request. Batching
+// avgBatchSize messages per request divides the number of billed requests
+// accordingly, as long as a batch stays below the 1000 bytes minimum.
+//
+// The returned map contains unbatched_cost and batched_cost in USD and
+// savings_percent.
+func (ps *PubSub) BatchingCostAnalysis(singleMessageCostUSD float64, avgBatchSize float64, totalMessages int) map[string]float64 {
+	if avgBatchSize < 1 {
+		avgBatchSize = 1
+	}
+
+	unbatched := singleMessageCostUSD * float64(totalMessages)
+	batched := singleMessageCostUSD * math.Ceil(float64(totalMessages)/avgBatchSize)
+
+	savings := 0.0
+	if unbatched > 0 {
+		savings = (unbatched - batched) / unbatched * 100
+	}
+
+	return map[string]float64{
+		"unbatched_cost":  unbatched,
+		"batched_cost":    batched,
+		"savings_percent": savings,
+	}
+}
+
+// ThroughputCapacity estimates how many messages of avgMessageSizeBytes bytes
+// can be published per second over a bandwidthMbps link, and what publishing
+// at that rate for a 30 day month costs at the Pub/Sub throughput price of
+// $40 per TiB. Messages are assumed to be batched, so the 1000 bytes minimum
+// billed per request does not apply, and the free tier is ignored.
+//
+// The returned map contains messages_per_second, bytes_per_second and
+// monthly_cost_usd.
+func (ps *PubSub) ThroughputCapacity(bandwidthMbps float64, avgMessageSizeBytes int) map[string]float64 {
+	bytesPerSecond := bandwidthMbps * 1000 * 1000 / 8
+
+	messagesPerSecond := 0.0
+	if avgMessageSizeBytes > 0 {
+		messagesPerSecond = bytesPerSecond / float64(avgMessageSizeBytes)
+	}
+
+	return map[string]float64{
+		"messages_per_second": messagesPerSecond,
+		"bytes_per_second":    bytesPerSecond,
+		"monthly_cost_usd":    bytesPerSecond * secondsPerMonth / bytesPerTiB * pricePerTiBUSD,
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package pubsub
+
+import "time"
+
+// processCPUTime is not supported on Windows and always returns 0.
+func processCPUTime() time.Duration {
+	return 0
+}
@@ -1,6 +1,13 @@
 package pubsub
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInjectedFault is returned instead of publishing when a publish was picked
+// to fail by the configured ErrorInjectionRate.
+var ErrInjectedFault = errors.New("xk6-pubsub: injected fault")
 
 func ReportError(err error, msg string) {
 	if err != nil {
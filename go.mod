@@ -8,4 +8,6 @@ require (
 	github.com/mitchellh/mapstructure v1.1.2
 	go.k6.io/k6 v0.45.0
 	google.golang.org/api v0.110.0
+	google.golang.org/grpc v1.55.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,80 @@
+package pubsub
+
+import "sync"
+
+// publishHistorySize is the number of most recent publish results kept per
+// topic by PublisherClient.
+const publishHistorySize = 1000
+
+// publishHistory keeps the results of the most recent publishes per topic in
+// fixed-size ring buffers. It is safe for concurrent use.
+type publishHistory struct {
+	mu     sync.Mutex
+	topics map[string]*resultRing
+}
+
+// resultRing is a fixed-size ring buffer of publish results.
+type resultRing struct {
+	results [publishHistorySize]bool
+	next    int
+	count   int
+}
+
+func newPublishHistory() *publishHistory {
+	return &publishHistory{topics: map[string]*resultRing{}}
+}
+
+// record stores the result of a publish to the provided topic, overwriting
+// the oldest result once the buffer is full.
+func (h *publishHistory) record(topic string, success bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ring, ok := h.topics[topic]
+	if !ok {
+		ring = &resultRing{}
+		h.topics[topic] = ring
+	}
+
+	ring.results[ring.next] = success
+	ring.next = (ring.next + 1) % publishHistorySize
+	if ring.count < publishHistorySize {
+		ring.count++
+	}
+}
+
+// successRate returns the fraction of the last windowSize publishes to the
+// provided topic that succeeded.
+func (h *publishHistory) successRate(topic string, windowSize int) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ring, ok := h.topics[topic]
+	if !ok || ring.count == 0 {
+		return 1
+	}
+
+	if windowSize < 1 || windowSize > ring.count {
+		windowSize = ring.count
+	}
+
+	succeeded := 0
+	for i := 1; i <= windowSize; i++ {
+		idx := (ring.next - i + publishHistorySize) % publishHistorySize
+		if ring.results[idx] {
+			succeeded++
+		}
+	}
+
+	return float64(succeeded) / float64(windowSize)
+}
+
+// RecentSuccessRate returns the fraction (0.0 - 1.0) of the last windowSize
+// publishes to the provided topic made with the PublisherClient that
+// succeeded. At most the last 1000 publishes per topic are remembered; a
+// bigger windowSize, or one less than 1, covers all the remembered publishes.
+// If nothing was published to the topic yet, 1 is returned so that circuit
+// breakers start closed.
+func (ps *PubSub) RecentSuccessRate(p *PublisherClient, topic string, windowSize int) float64 {
+	return p.history.successRate(topic, windowSize)
+}
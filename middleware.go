@@ -0,0 +1,74 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// PublishMiddleware transforms a message before it is published to topic.
+type PublishMiddleware func(topic string, msg *message.Message) *message.Message
+
+// publishMiddlewares is the chain of PublishMiddleware registered on a
+// PublisherClient. It is safe for concurrent use.
+type publishMiddlewares struct {
+	mu  sync.Mutex
+	fns []PublishMiddleware
+}
+
+// UsePublishMiddleware registers fn to be applied to every message published
+// with the PublisherClient, before it is sent. Middlewares are applied in the
+// order they were registered and must return the message to publish, which
+// may be the modified msg or a new one with the same UUID. The UUID is sent
+// to the consumers and returned by the publish functions, so a middleware
+// that changes it fails the publish.
+//
+// Middlewares are JS functions bound to the VU that registered them, so they
+// only run on the VU goroutine: they are not applied by BenchmarkWithResources,
+// and an error is returned for clients shared between VUs with
+// GetOrCreatePublisher. A middleware that throws fails the publish with its
+// error.
+func (c *PublisherClient) UsePublishMiddleware(fn PublishMiddleware) error {
+	if c.shared {
+		return errors.New("xk6-pubsub: publish middlewares cannot be used on a shared publisher")
+	}
+
+	c.middlewares.mu.Lock()
+	defer c.middlewares.mu.Unlock()
+
+	c.middlewares.fns = append(c.middlewares.fns, fn)
+
+	return nil
+}
+
+// apply runs the message through all the registered middlewares. A panic of
+// a middleware, which is how goja surfaces a JS exception, is returned as an
+// error.
+//
+// The lock is not held while the middlewares run, so a middleware may publish
+// with the same client or register another middleware.
+func (m *publishMiddlewares) apply(topic string, msg *message.Message) (_ *message.Message, err error) {
+	m.mu.Lock()
+	fns := append([]PublishMiddleware(nil), m.fns...)
+	m.mu.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("xk6-pubsub: publish middleware failed: %v", r)
+		}
+	}()
+
+	for _, fn := range fns {
+		uuid := msg.UUID
+		if msg = fn(topic, msg); msg == nil {
+			return nil, errors.New("xk6-pubsub: publish middleware returned no message")
+		}
+		if msg.UUID != uuid {
+			return nil, fmt.Errorf("xk6-pubsub: publish middleware changed the message UUID from %q to %q", uuid, msg.UUID)
+		}
+	}
+
+	return msg, nil
+}
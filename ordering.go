@@ -0,0 +1,68 @@
+package pubsub
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// DetectReorder checks whether messages sharing an ordering key were received
+// out of sequence. The messages are expected in the order they were received
+// and in the Pub/Sub JSON representation, i.e. with messageId, orderingKey and
+// attributes fields, as delivered to push endpoints.
+//
+// For every ordering key the numeric value of the sequenceAttribute attribute
+// must never decrease. DetectReorder returns whether any message broke that
+// rule together with the IDs of the offending messages. Messages without an
+// ordering key or without a numeric sequenceAttribute are ignored.
+func (ps *PubSub) DetectReorder(messages []map[string]interface{}, sequenceAttribute string) (bool, []string) {
+	highest := map[string]float64{}
+	offending := []string{}
+
+	for _, msg := range messages {
+		key, _ := msg["orderingKey"].(string)
+		if key == "" {
+			continue
+		}
+
+		seq, ok := sequenceValue(msg["attributes"], sequenceAttribute)
+		if !ok {
+			continue
+		}
+
+		if last, seen := highest[key]; seen && seq < last {
+			offending = append(offending, fmt.Sprint(msg["messageId"]))
+			continue
+		}
+		highest[key] = seq
+	}
+
+	return len(offending) > 0, offending
+}
+
+// sequenceValue reads the named attribute from a message attributes value and
+// parses it as a number.
+func sequenceValue(attributes interface{}, name string) (float64, bool) {
+	var raw string
+	switch attrs := attributes.(type) {
+	case map[string]interface{}:
+		value, ok := attrs[name]
+		if !ok {
+			return 0, false
+		}
+		raw = fmt.Sprint(value)
+	case map[string]string:
+		var ok bool
+		if raw, ok = attrs[name]; !ok {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	seq, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return seq, true
+}
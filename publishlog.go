@@ -0,0 +1,104 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// publishLog writes one JSON object per publish attempt to a file in the JSON
+// Lines format. It is safe for concurrent use.
+type publishLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// publishLogEntry is a single line of a publishLog.
+type publishLogEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Topic     string    `json:"topic"`
+	MsgID     string    `json:"msgID"`
+	LatencyMs float64   `json:"latencyMs"`
+	Error     *string   `json:"error"`
+}
+
+// open starts writing to the file at filePath, appending to it if it exists.
+// A file opened before is closed.
+func (l *publishLog) open(filePath string) error {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		ReportError(l.file.Close(), "xk6-pubsub: unable to close publish log")
+	}
+	l.file = file
+
+	return nil
+}
+
+// write logs a publish attempt of the message with the provided UUID, started
+// at start and ended with err. Nothing is written if no file was opened.
+func (l *publishLog) write(topic, uuid string, start time.Time, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return
+	}
+
+	entry := publishLogEntry{
+		Timestamp: start,
+		Topic:     topic,
+		MsgID:     uuid,
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		msg := err.Error()
+		entry.Error = &msg
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		ReportError(err, "xk6-pubsub: unable to encode publish log entry")
+		return
+	}
+
+	if _, err := fmt.Fprintf(l.file, "%s\n", line); err != nil {
+		ReportError(err, "xk6-pubsub: unable to write publish log entry")
+	}
+}
+
+// close stops writing and closes the file, if any.
+func (l *publishLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+// EnableJSONLLog makes the PublisherClient log every publish attempt to the
+// file at filePath in the JSON Lines format, appending to the file if it
+// exists. Every line contains the timestamp, topic, msgID, latencyMs and
+// error (null on success) of an attempt. The file is closed with the client.
+func (ps *PubSub) EnableJSONLLog(p *PublisherClient, filePath string) error {
+	if err := p.log.open(filePath); err != nil {
+		ReportError(err, "xk6-pubsub: unable to open publish log")
+		return err
+	}
+
+	return nil
+}
@@ -1,8 +1,19 @@
 package pubsub
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ThreeDotsLabs/watermill"
@@ -14,6 +25,9 @@ import (
 
 	"github.com/mitchellh/mapstructure"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"gopkg.in/yaml.v3"
 )
 
 // Register the extension on module initialization, available to
@@ -52,80 +66,776 @@ type publisherConf struct {
 	Debug                     bool
 	Trace                     bool
 	DoNotCreateTopicIfMissing bool
+	ErrorInjectionRate        float64
+	ArtificialLatencyMs       int
+	QuotaProject              string
+	DryRun                    bool
+	GCPTraceHeader            string
+}
+
+// PublisherClient is the publisher client returned to the k6 scripts. It keeps
+// the googlecloud.Publisher together with the publisherConf it was created
+// from, so the per-client settings can be applied on every publish.
+type PublisherClient struct {
+	// mu guards publisher, which is replaced by ResetClientState.
+	mu        sync.RWMutex
+	publisher *googlecloud.Publisher
+
+	conf        *publisherConf
+	history     *publishHistory
+	cache       *publishCache
+	middlewares publishMiddlewares
+	log         publishLog
+
+	// shared is set on the clients registered by GetOrCreatePublisher, which
+	// are used by several VUs.
+	shared bool
+}
+
+// Close closes the underlying googlecloud.Publisher. Publishes that are in
+// flight, including the ones PublishDeadlined left running in the background,
+// are completed before the connection is closed. The publish log enabled
+// with EnableJSONLLog, if any, is closed as well.
+func (c *PublisherClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ReportError(c.log.close(), "xk6-pubsub: unable to close publish log")
+
+	return c.publisher.Close()
+}
+
+// recordResult records the outcome of a publish attempt of the message with
+// the provided UUID to topic, started at start.
+func (c *PublisherClient) recordResult(topic, uuid string, start time.Time, err error) {
+	c.history.record(topic, err == nil)
+	c.log.write(topic, uuid, start, err)
 }
 
 // Publisher is the basic wrapper for Google Pub/Sub publisher and uses
 // watermill as a client. See https://github.com/ThreeDotsLabs/watermill/
 //
 // Publisher represents the constructor and creates an instance of
-// googlecloud.Publisher with provided projectID and publishTimeout.
+// PublisherClient with provided projectID and publishTimeout.
 // Publisher uses watermill StdLoggerAdapter logger.
-func (ps *PubSub) Publisher(config map[string]interface{}) *googlecloud.Publisher {
-	cnf := &publisherConf{}
-	err := mapstructure.Decode(config, cnf)
+func (ps *PubSub) Publisher(config map[string]interface{}) *PublisherClient {
+	cnf, err := decodePublisherConf(config)
 	if err != nil {
 		log.Fatalf("xk6-pubsub: unable to read publisher config: %v", err)
 	}
 
+	client, err := newPublisher(cnf)
+	if err != nil {
+		log.Fatalf("xk6-pubsub: unable to init publisher: %v", err)
+	}
+
+	return client
+}
+
+// sharedPublishers holds the PublisherClient instances shared between VUs by
+// GetOrCreatePublisher, keyed by the key provided by the script.
+var sharedPublishers sync.Map
+
+// GetOrCreatePublisher returns the PublisherClient registered under key,
+// creating it from config with Publisher if there is none yet. All the VUs
+// using the same key share a single client and its connection. The config of
+// later calls with an existing key is ignored. Shared clients do not accept
+// publish middlewares, see UsePublishMiddleware.
+func (ps *PubSub) GetOrCreatePublisher(key string, config map[string]interface{}) *PublisherClient {
+	if client, ok := sharedPublishers.Load(key); ok {
+		return client.(*PublisherClient)
+	}
+
+	created := ps.Publisher(config)
+	created.shared = true
+	client, loaded := sharedPublishers.LoadOrStore(key, created)
+	if loaded {
+		// Another VU registered its client first, so the one created here is not needed.
+		if err := created.Close(); err != nil {
+			ReportError(err, "xk6-pubsub: unable to close publisher")
+		}
+	}
+
+	return client.(*PublisherClient)
+}
+
+// PublisherFromYAMLFile creates a publisher the same way Publisher does, but
+// reads the configuration from the YAML file at filePath, see
+// PublisherFromYAML. The file is read from the file system of the k6 process:
+// a relative filePath is resolved against the working directory, not the
+// script directory, and the file is not included by k6 archive.
+func (ps *PubSub) PublisherFromYAMLFile(filePath string) (*PublisherClient, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("xk6-pubsub: unable to read publisher config file: %w", err)
+	}
+
+	return ps.PublisherFromYAML(string(data))
+}
+
+// PublisherFromYAML creates a publisher the same way Publisher does, but reads
+// the configuration from the provided YAML document, e.g. the contents of a
+// file loaded with the k6 open function. The document uses the same keys as
+// the config object passed to Publisher, e.g. projectID or publishTimeout.
+func (ps *PubSub) PublisherFromYAML(yamlConfig string) (*PublisherClient, error) {
+	config := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(yamlConfig), &config); err != nil {
+		return nil, fmt.Errorf("xk6-pubsub: unable to parse publisher config: %w", err)
+	}
+
+	cnf, err := decodePublisherConf(config)
+	if err != nil {
+		return nil, fmt.Errorf("xk6-pubsub: unable to read publisher config: %w", err)
+	}
+
+	client, err := newPublisher(cnf)
+	if err != nil {
+		return nil, fmt.Errorf("xk6-pubsub: unable to init publisher: %w", err)
+	}
+
+	return client, nil
+}
+
+// bounceDelay is how long BouncePublisher waits between closing the old
+// publisher and creating the new one.
+const bounceDelay = 500 * time.Millisecond
+
+// BouncePublisher closes the provided publisher and, after a short delay,
+// returns a new one created from config. It simulates a dropped connection
+// and allows testing how the system behaves when the publisher reconnects.
+// The publish history, the cache, the middlewares and the JSONL log of the
+// old client are not carried over to the new one. The ctx error is returned
+// if the VU context is done during the delay.
+func (ps *PubSub) BouncePublisher(p *PublisherClient, config map[string]interface{}) (*PublisherClient, error) {
+	cnf, err := decodePublisherConf(config)
+	if err != nil {
+		return nil, fmt.Errorf("xk6-pubsub: unable to read publisher config: %w", err)
+	}
+
+	if err := p.Close(); err != nil {
+		ReportError(err, "xk6-pubsub: unable to close publisher")
+	}
+
+	if err := sleepContext(ps.vu.Context(), bounceDelay); err != nil {
+		return nil, err
+	}
+
+	client, err := newPublisher(cnf)
+	if err != nil {
+		return nil, fmt.Errorf("xk6-pubsub: unable to init publisher: %w", err)
+	}
+
+	return client, nil
+}
+
+// decodePublisherConf reads a publisherConf from the provided config map and
+// applies default values to the missing parameters.
+func decodePublisherConf(config map[string]interface{}) (*publisherConf, error) {
+	cnf := &publisherConf{}
+	if err := mapstructure.Decode(config, cnf); err != nil {
+		return nil, err
+	}
+
 	if cnf.PublishTimeout < 1 {
 		cnf.PublishTimeout = 5
 	}
 
-	client, err := googlecloud.NewPublisher(
+	return cnf, nil
+}
+
+// newPublisher creates an instance of PublisherClient from the provided
+// publisherConf.
+func newPublisher(cnf *publisherConf) (*PublisherClient, error) {
+	publisher, err := newGooglecloudPublisher(cnf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PublisherClient{
+		publisher: publisher,
+		conf:      cnf,
+		history:   newPublishHistory(),
+		cache:     newPublishCache(),
+	}, nil
+}
+
+// newGooglecloudPublisher creates an instance of googlecloud.Publisher from
+// the provided publisherConf.
+func newGooglecloudPublisher(cnf *publisherConf) (*googlecloud.Publisher, error) {
+	return googlecloud.NewPublisher(
 		googlecloud.PublisherConfig{
 			ProjectID:                 cnf.ProjectID,
 			Marshaler:                 googlecloud.DefaultMarshalerUnmarshaler{},
 			PublishTimeout:            time.Second * time.Duration(cnf.PublishTimeout),
 			DoNotCreateTopicIfMissing: cnf.DoNotCreateTopicIfMissing,
-			ClientOptions:             withCredentials(cnf.Credentials),
+			ClientOptions:             clientOptions(cnf),
 		},
 		watermill.NewStdLogger(cnf.Debug, cnf.Trace),
 	)
+}
 
+// ResetClientState closes the publisher of the provided PublisherClient and
+// replaces it with a new one created from the same configuration. Publishes
+// that are in flight are completed before the publisher is closed. Scripts
+// keep using the same client, which allows testing how the system recovers
+// after the publisher was reset.
+func (ps *PubSub) ResetClientState(p *PublisherClient) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.publisher.Close(); err != nil {
+		ReportError(err, "xk6-pubsub: unable to close publisher")
+	}
+
+	publisher, err := newGooglecloudPublisher(p.conf)
 	if err != nil {
-		log.Fatalf("xk6-pubsub: unable to init publisher: %v", err)
+		ReportError(err, "xk6-pubsub: unable to init publisher")
+		return err
 	}
+	p.publisher = publisher
 
-	return client
+	return nil
 }
 
 // Publish publishes a message using the function publishMessage.
 // The msg value must be passed as string and will be converted to bytes
 // sequence before publishing.
-func (ps *PubSub) Publish(p *googlecloud.Publisher, topic, msg string) error {
+func (ps *PubSub) Publish(p *PublisherClient, topic, msg string) error {
 	newMessage := message.NewMessage(watermill.NewShortUUID(), []byte(msg))
-	return publishMessage(p, topic, newMessage, ps.vu.State())
+	return publishMessage(ps.vu.Context(), p, topic, newMessage, ps.vu.State())
 }
 
 // PublishWithAttributes publishes a message using the function publishMessage.
 // The msg value must be passed as string and will be converted to a bytes
 // sequence before publishing. The attributes value must be passed as map[string]string
 // and will be set as metadata.
-func (ps *PubSub) PublishWithAttributes(p *googlecloud.Publisher, topic, msg string, attributes map[string]string) error {
+func (ps *PubSub) PublishWithAttributes(p *PublisherClient, topic, msg string, attributes map[string]string) error {
 	newMessage := createMessage(watermill.NewShortUUID(), []byte(msg), attributes)
-	return publishMessage(p, topic, newMessage, ps.vu.State())
+	return publishMessage(ps.vu.Context(), p, topic, newMessage, ps.vu.State())
+}
+
+// deliveryGuaranteeAttribute is the attribute set by PublishWithDeliveryHint.
+const deliveryGuaranteeAttribute = "x-delivery-guarantee"
+
+// PublishWithDeliveryHint publishes a message using the function publishMessage
+// with an x-delivery-guarantee attribute set to "at-least-once" or "best-effort".
+// Pub/Sub itself ignores the attribute; it tells consumers which handling the
+// publisher intended. The UUID of the published message is returned.
+func (ps *PubSub) PublishWithDeliveryHint(p *PublisherClient, topic, msg string, atLeastOnce bool) (string, error) {
+	guarantee := "best-effort"
+	if atLeastOnce {
+		guarantee = "at-least-once"
+	}
+
+	newMessage := createMessage(watermill.NewShortUUID(), []byte(msg), message.Metadata{
+		deliveryGuaranteeAttribute: guarantee,
+	})
+	if err := publishMessage(ps.vu.Context(), p, topic, newMessage, ps.vu.State()); err != nil {
+		return "", err
+	}
+
+	return newMessage.UUID, nil
+}
+
+// PublishWithSpan publishes a message using the function publishMessage with
+// B3 tracing attributes. A new trace ID and span ID are generated and set as
+// x-b3-traceid and x-b3-spanid, and parentSpanID is set as x-b3-parentspanid,
+// so the message can be correlated with the span that published it in
+// Zipkin or Jaeger. An empty parentSpanID marks a root span, which has no
+// x-b3-parentspanid attribute. The UUID of the published message is returned.
+func (ps *PubSub) PublishWithSpan(p *PublisherClient, topic, msg, parentSpanID string) (string, error) {
+	attributes := message.Metadata{
+		"x-b3-traceid": fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64()),
+		"x-b3-spanid":  fmt.Sprintf("%016x", rand.Uint64()),
+	}
+	if parentSpanID != "" {
+		attributes["x-b3-parentspanid"] = parentSpanID
+	}
+
+	newMessage := createMessage(watermill.NewShortUUID(), []byte(msg), attributes)
+	if err := publishMessage(ps.vu.Context(), p, topic, newMessage, ps.vu.State()); err != nil {
+		return "", err
+	}
+
+	return newMessage.UUID, nil
+}
+
+// PublishWithTTL publishes a message using the function publishMessage with
+// an x-message-ttl attribute set to ttlMs and an x-expires-at attribute set to
+// the time the message expires, in milliseconds since the Unix epoch.
+// Pub/Sub does not discard the message; consumers can use the attributes to
+// drop expired messages. The UUID of the published message is returned.
+func (ps *PubSub) PublishWithTTL(p *PublisherClient, topic, msg string, ttlMs int64) (string, error) {
+	expiresAt := time.Now().Add(time.Duration(ttlMs) * time.Millisecond)
+
+	newMessage := createMessage(watermill.NewShortUUID(), []byte(msg), message.Metadata{
+		"x-message-ttl": strconv.FormatInt(ttlMs, 10),
+		"x-expires-at":  strconv.FormatInt(expiresAt.UnixNano()/int64(time.Millisecond), 10),
+	})
+	if err := publishMessage(ps.vu.Context(), p, topic, newMessage, ps.vu.State()); err != nil {
+		return "", err
+	}
+
+	return newMessage.UUID, nil
 }
 
-// publishMessage publishes a message to the provided topic using provided
-// googlecloud.Publisher. The message value must be passed as Message, a watermill struct.
-func publishMessage(p *googlecloud.Publisher, topic string, message *message.Message, state *lib.State) error {
+// PublishDeadlined publishes a message using the function publishMessageWith
+// and fails with context.DeadlineExceeded if the publish does not complete
+// within hardDeadlineMs milliseconds. The publish is not retried. The UUID of
+// the published message is returned.
+//
+// The watermill publisher cannot cancel a publish, so at the deadline
+// PublishDeadlined only stops waiting. A deadline error does not mean the
+// message was not delivered: it may still be published afterwards.
+func (ps *PubSub) PublishDeadlined(p *PublisherClient, topic, msg string, hardDeadlineMs int) (string, error) {
+	ctx, cancel := context.WithDeadline(ps.vu.Context(), time.Now().Add(time.Duration(hardDeadlineMs)*time.Millisecond))
+	defer cancel()
+
+	newMessage := message.NewMessage(watermill.NewShortUUID(), []byte(msg))
+	opts := publishOptions{stopWaitingOnDone: true}
+	if err := publishMessageWith(ctx, p, topic, newMessage, ps.vu.State(), opts); err != nil {
+		return "", err
+	}
+
+	return newMessage.UUID, nil
+}
+
+// ThrottledPublish publishes every message of msgs using the function
+// publishAll, waiting until at least minDelayMs milliseconds passed since the
+// previous publish started. It stops at the first failed publish. The UUIDs
+// of the published messages are returned in publication order.
+func (ps *PubSub) ThrottledPublish(p *PublisherClient, topic string, msgs []string, minDelayMs int) ([]string, error) {
+	return ps.publishAll(p, topic, msgs, time.Duration(minDelayMs)*time.Millisecond)
+}
+
+// PublishFromDataFeed publishes one message per row of feed, e.g. a k6
+// SharedArray loaded from a CSV file, using the function publishMessage. The
+// value of the msgField column is used as the message data. If topicField is
+// not empty and the row has a non-empty value in that column, the message is
+// published to that topic instead of the provided one. It stops at the first
+// failed publish, or at the first row without a msgField value, and returns
+// the number of published messages.
+func (ps *PubSub) PublishFromDataFeed(p *PublisherClient, topic string, feed []map[string]interface{}, msgField, topicField string) (int, error) {
+	published := 0
+	for i, row := range feed {
+		data, ok := row[msgField]
+		if !ok || data == nil {
+			err := fmt.Errorf("xk6-pubsub: row %d has no %q value", i, msgField)
+			ReportError(err, "xk6-pubsub: invalid message")
+			return published, err
+		}
+
+		rowTopic := topic
+		if topicField != "" {
+			if value, ok := row[topicField].(string); ok && value != "" {
+				rowTopic = value
+			}
+		}
+
+		newMessage := message.NewMessage(watermill.NewShortUUID(), []byte(fmt.Sprint(data)))
+		if err := publishMessage(ps.vu.Context(), p, rowTopic, newMessage, ps.vu.State()); err != nil {
+			return published, err
+		}
+		published++
+	}
+
+	return published, nil
+}
+
+// PublishAroundRestart publishes the first restartAfter messages of msgs using
+// the function publishMessage, restarts the publisher of the client with
+// ResetClientState and publishes the remaining messages. The UUIDs of the
+// messages published before and after the restart are returned separately,
+// so they can be compared with the received messages to detect any loss. An
+// error is returned if restartAfter is not between 0 and the number of msgs.
+func (ps *PubSub) PublishAroundRestart(p *PublisherClient, topic string, msgs []string, restartAfter int) ([]string, []string, error) {
+	if restartAfter < 0 || restartAfter > len(msgs) {
+		return nil, nil, fmt.Errorf("xk6-pubsub: restartAfter must be between 0 and %d, got %d", len(msgs), restartAfter)
+	}
+
+	before, err := ps.publishAll(p, topic, msgs[:restartAfter], 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := ps.ResetClientState(p); err != nil {
+		return nil, nil, err
+	}
+
+	after, err := ps.publishAll(p, topic, msgs[restartAfter:], 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return before, after, nil
+}
+
+// publishAll publishes msgs one by one using the function publishMessage and
+// returns their UUIDs. When minDelay is positive, every publish starts at
+// least minDelay after the previous one. It stops at the first failed publish
+// or when the VU context is done.
+func (ps *PubSub) publishAll(p *PublisherClient, topic string, msgs []string, minDelay time.Duration) ([]string, error) {
+	ctx := ps.vu.Context()
+	ids := make([]string, 0, len(msgs))
+
+	var last time.Time
+	for _, msg := range msgs {
+		if wait := minDelay - time.Since(last); !last.IsZero() && wait > 0 {
+			if err := sleepContext(ctx, wait); err != nil {
+				return ids, err
+			}
+		}
+		last = time.Now()
+
+		newMessage := message.NewMessage(watermill.NewShortUUID(), []byte(msg))
+		if err := publishMessage(ctx, p, topic, newMessage, ps.vu.State()); err != nil {
+			return ids, err
+		}
+		ids = append(ids, newMessage.UUID)
+	}
+
+	return ids, nil
+}
+
+// crc32cTable is the Castagnoli table used by PublishWithCRC, the same CRC32C
+// Google Cloud uses for its checksums.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// PublishWithCRC publishes a message using the function publishMessage with an
+// x-crc32c attribute holding the CRC32C checksum of the data as 8 hex digits,
+// so consumers can verify the integrity of the received data. The UUID of the
+// published message is returned.
+func (ps *PubSub) PublishWithCRC(p *PublisherClient, topic, msg string) (string, error) {
+	data := []byte(msg)
+
+	newMessage := createMessage(watermill.NewShortUUID(), data, message.Metadata{
+		"x-crc32c": fmt.Sprintf("%08x", crc32.Checksum(data, crc32cTable)),
+	})
+	if err := publishMessage(ps.vu.Context(), p, topic, newMessage, ps.vu.State()); err != nil {
+		return "", err
+	}
+
+	return newMessage.UUID, nil
+}
+
+// rampCheckInterval is the longest RampedPublish waits before recomputing
+// when the next message is due, so a low rate at the start of the ramp does
+// not delay the messages due once the rate has increased.
+const rampCheckInterval = 100 * time.Millisecond
+
+// RampedPublish publishes msg repeatedly using the function publishMessage for
+// durationMs milliseconds, linearly changing the publish rate from
+// startRateMsgPerSec to endRateMsgPerSec. Messages are published as soon as
+// they are due according to the ramp, so slow publishes are caught up with.
+// It stops at the first failed publish or when the VU context is done, and
+// returns the number of published messages.
+func (ps *PubSub) RampedPublish(p *PublisherClient, topic, msg string, startRateMsgPerSec, endRateMsgPerSec float64, durationMs int) (int, error) {
+	ctx := ps.vu.Context()
+	duration := time.Duration(durationMs) * time.Millisecond
+	slope := 0.0
+	if duration > 0 {
+		slope = (endRateMsgPerSec - startRateMsgPerSec) / duration.Seconds()
+	}
+
+	start := time.Now()
+	published := 0
+
+	for {
+		elapsed := time.Since(start)
+		remaining := duration - elapsed
+		if remaining <= 0 {
+			return published, nil
+		}
+
+		// due is the number of messages the ramp expects to be published so
+		// far, the integral of the rate since the start.
+		t := elapsed.Seconds()
+		rate := startRateMsgPerSec + slope*t
+		due := startRateMsgPerSec*t + slope*t*t/2
+
+		if due >= float64(published+1) {
+			newMessage := message.NewMessage(watermill.NewShortUUID(), []byte(msg))
+			if err := publishMessage(ctx, p, topic, newMessage, ps.vu.State()); err != nil {
+				return published, err
+			}
+			published++
+			continue
+		}
+
+		wait := rampCheckInterval
+		if rate > 0 {
+			next := time.Duration((float64(published+1) - due) / rate * float64(time.Second))
+			if next < wait {
+				wait = next
+			}
+		}
+		if remaining < wait {
+			wait = remaining
+		}
+
+		if err := sleepContext(ctx, wait); err != nil {
+			return published, err
+		}
+	}
+}
+
+// UnreliablePublish simulates a lossy network: with a probability of lossRate
+// (0.0 - 1.0) the message is dropped without being published and ("", false,
+// nil) is returned. Otherwise it is published using the function
+// publishMessage and its UUID is returned with true.
+func (ps *PubSub) UnreliablePublish(p *PublisherClient, topic, msg string, lossRate float64) (string, bool, error) {
+	if rand.Float64() < lossRate {
+		return "", false, nil
+	}
+
+	newMessage := message.NewMessage(watermill.NewShortUUID(), []byte(msg))
+	if err := publishMessage(ps.vu.Context(), p, topic, newMessage, ps.vu.State()); err != nil {
+		return "", false, err
+	}
+
+	return newMessage.UUID, true, nil
+}
+
+// schemaEncodingAttribute is the attribute set by PublishProtoBytes.
+const schemaEncodingAttribute = "x-goog-pubsub-schema-encoding"
+
+// PublishProtoBytes publishes an already serialised protobuf message using the
+// function publishMessage. The encoding value must be "BINARY" or "JSON" and
+// is set as the x-goog-pubsub-schema-encoding attribute. Pub/Sub itself
+// ignores the attribute and validates the data against the schema settings of
+// the topic; it tells consumers how the data was encoded. The UUID of the
+// published message is returned.
+func (ps *PubSub) PublishProtoBytes(p *PublisherClient, topic string, protoBytes []byte, encoding string) (string, error) {
+	if encoding != "BINARY" && encoding != "JSON" {
+		err := fmt.Errorf("xk6-pubsub: unsupported schema encoding %q, must be BINARY or JSON", encoding)
+		ReportError(err, "xk6-pubsub: invalid message")
+		return "", err
+	}
+
+	newMessage := createMessage(watermill.NewShortUUID(), protoBytes, message.Metadata{
+		schemaEncodingAttribute: encoding,
+	})
+	if err := publishMessage(ps.vu.Context(), p, topic, newMessage, ps.vu.State()); err != nil {
+		return "", err
+	}
+
+	return newMessage.UUID, nil
+}
+
+// DryRunPublish publishes a message using the function publishMessage unless
+// DryRun is enabled in the publisher configuration. In dry run mode the
+// message is only validated against the Pub/Sub limits and a synthetic ID is
+// returned, "dry-run-" followed by the first 16 hex characters of the SHA-256
+// of the data, so script logic can be tested without sending anything.
+// Otherwise the UUID of the published message is returned.
+func (ps *PubSub) DryRunPublish(p *PublisherClient, topic, msg string) (string, error) {
+	newMessage := message.NewMessage(watermill.NewShortUUID(), []byte(msg))
+
+	if p.conf.DryRun {
+		if err := validateMessage(newMessage.Payload, newMessage.Metadata); err != nil {
+			ReportError(err, "xk6-pubsub: invalid message")
+			return "", err
+		}
+
+		sum := sha256.Sum256(newMessage.Payload)
+		return "dry-run-" + hex.EncodeToString(sum[:])[:16], nil
+	}
+
+	if err := publishMessage(ps.vu.Context(), p, topic, newMessage, ps.vu.State()); err != nil {
+		return "", err
+	}
+
+	return newMessage.UUID, nil
+}
+
+// publishOptions changes how publishMessageWith publishes a message.
+type publishOptions struct {
+	// stopWaitingOnDone makes publishMessageWith return the ctx error as soon
+	// as ctx is done, even while the message is being published. The publish
+	// keeps running in the background and may still deliver the message.
+	stopWaitingOnDone bool
+	// skipMiddlewares makes publishMessageWith publish the message without
+	// applying the middlewares registered with UsePublishMiddleware. It must
+	// be set when publishing from a goroutine other than the VU one.
+	skipMiddlewares bool
+}
+
+// publishMessage publishes a message using the function publishMessageWith
+// with the default publishOptions.
+func publishMessage(ctx context.Context, p *PublisherClient, topic string, message *message.Message, state *lib.State) error {
+	return publishMessageWith(ctx, p, topic, message, state, publishOptions{})
+}
+
+// publishMessageWith publishes a message to the provided topic using provided
+// PublisherClient. The message value must be passed as Message, a watermill struct.
+// When ErrorInjectionRate is configured, the matching fraction of calls fails
+// with ErrInjectedFault without publishing. When ArtificialLatencyMs is
+// configured, every publish is delayed by that many milliseconds. When Debug
+// is enabled, every message is logged as JSON before it is published. The
+// middlewares registered with UsePublishMiddleware are applied first.
+//
+// The ctx value is usually the VU context. When it is done before the message
+// is sent, publishMessageWith returns its error without publishing. The watermill
+// publisher does not accept a context, so a publish that was already sent
+// cannot be cancelled and only ends when it completes or PublishTimeout
+// expires.
+//
+// Every call is recorded exactly once in the publish history and the JSONL
+// log, with the error it returns.
+func publishMessageWith(ctx context.Context, p *PublisherClient, topic string, message *message.Message, state *lib.State, opts publishOptions) error {
+	start := time.Now()
+	err := tryPublishMessage(ctx, p, topic, message, state, opts)
+	p.recordResult(topic, message.UUID, start, err)
+
+	if err != nil {
+		ReportError(err, "xk6-pubsub: unable to publish message")
+		return err
+	}
+
+	return nil
+}
+
+// tryPublishMessage runs a single publish attempt for publishMessageWith and
+// returns its outcome without recording or reporting it.
+func tryPublishMessage(ctx context.Context, p *PublisherClient, topic string, message *message.Message, state *lib.State, opts publishOptions) error {
 	if state == nil {
-		err := errors.New("xk6-pubsub: state is nil")
-		ReportError(err, "cannot determine state")
+		return errors.New("xk6-pubsub: state is nil")
+	}
+
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	err := p.Publish(
+	if !opts.skipMiddlewares {
+		sent, err := p.middlewares.apply(topic, message)
+		if err != nil {
+			return err
+		}
+		message = sent
+	}
+
+	if p.conf.ErrorInjectionRate > 0 && rand.Float64() < p.conf.ErrorInjectionRate {
+		return ErrInjectedFault
+	}
+
+	if p.conf.ArtificialLatencyMs > 0 {
+		latency := time.Duration(p.conf.ArtificialLatencyMs) * time.Millisecond
+		if err := sleepContext(ctx, latency); err != nil {
+			return err
+		}
+	}
+
+	if p.conf.Debug {
+		logMessage(topic, message)
+	}
+
+	if opts.stopWaitingOnDone {
+		return sendMessageUntilDone(ctx, p, topic, message)
+	}
+
+	return sendMessage(p, topic, message)
+}
+
+// sendMessage publishes the message with the googlecloud.Publisher of p.
+func sendMessage(p *PublisherClient, topic string, message *message.Message) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.publisher.Publish(
 		topic,
 		message,
 	)
+}
 
-	if err != nil {
-		ReportError(err, "xk6-pubsub: unable to publish message")
+// sendMessageUntilDone publishes the message using the function sendMessage
+// in the background and returns the ctx error if ctx is done before the
+// publish completes. The publish is not cancelled then.
+func sendMessageUntilDone(ctx context.Context, p *PublisherClient, topic string, message *message.Message) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- sendMessage(p, topic, message)
+	}()
+
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	return nil
+// sleepContext waits for d or until ctx is done, whichever happens first. It
+// returns the ctx error if ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// logMessage logs the message that is about to be published to the provided
+// topic as indented JSON.
+func logMessage(topic string, message *message.Message) {
+	out, err := json.MarshalIndent(struct {
+		Topic      string            `json:"topic"`
+		UUID       string            `json:"uuid"`
+		Data       string            `json:"data"`
+		Attributes map[string]string `json:"attributes"`
+	}{
+		Topic:      topic,
+		UUID:       message.UUID,
+		Data:       string(message.Payload),
+		Attributes: message.Metadata,
+	}, "", "  ")
+	if err != nil {
+		ReportError(err, "xk6-pubsub: unable to log message")
+		return
+	}
+
+	log.Printf("xk6-pubsub: publishing message\n%s", out)
+}
+
+// clientOptions builds the option.ClientOption list for the provided
+// publisherConf.
+func clientOptions(cnf *publisherConf) []option.ClientOption {
+	opt := withCredentials(cnf.Credentials)
+
+	if len(cnf.QuotaProject) > 0 {
+		opt = append(opt, option.WithQuotaProject(cnf.QuotaProject))
+	}
+
+	if len(cnf.GCPTraceHeader) > 0 {
+		opt = append(opt, withTraceHeader(cnf.GCPTraceHeader)...)
+	}
+
+	return opt
+}
+
+// traceHeaderKey is the gRPC metadata key linking a call to a Cloud Trace span.
+const traceHeaderKey = "x-cloud-trace-context"
+
+// withTraceHeader attaches the provided Cloud Trace context as gRPC metadata
+// to every outgoing call, so the Pub/Sub traces are linked to the test trace.
+func withTraceHeader(traceHeader string) []option.ClientOption {
+	return []option.ClientOption{
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(
+			func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+				ctx = metadata.AppendToOutgoingContext(ctx, traceHeaderKey, traceHeader)
+				return invoker(ctx, method, req, reply, cc, opts...)
+			},
+		)),
+		option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(
+			func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				ctx = metadata.AppendToOutgoingContext(ctx, traceHeaderKey, traceHeader)
+				return streamer(ctx, desc, cc, method, opts...)
+			},
+		)),
+	}
 }
 
 // withCredentials explicitly setup Pub/Sub credentials as option.ClientOption.
@@ -147,3 +857,42 @@ func createMessage(uuid string, payload message.Payload, metadata message.Metada
 		Payload:  payload,
 	}
 }
+
+// Limits enforced by Pub/Sub on published messages.
+// See https://cloud.google.com/pubsub/quotas#resource_limits
+const (
+	maxMessageSize        = 10 * 1000 * 1000
+	maxAttributes         = 100
+	maxAttributeKeySize   = 256
+	maxAttributeValueSize = 1024
+)
+
+// validateMessage checks the message data and attributes against the Pub/Sub
+// resource limits.
+func validateMessage(payload message.Payload, metadata message.Metadata) error {
+	size := len(payload)
+	for k, v := range metadata {
+		size += len(k) + len(v)
+	}
+	if size > maxMessageSize {
+		return fmt.Errorf("xk6-pubsub: message size %d exceeds the limit of %d bytes", size, maxMessageSize)
+	}
+
+	if len(metadata) > maxAttributes {
+		return fmt.Errorf("xk6-pubsub: message has %d attributes, the limit is %d", len(metadata), maxAttributes)
+	}
+
+	for k, v := range metadata {
+		if strings.HasPrefix(k, "goog") {
+			return fmt.Errorf("xk6-pubsub: attribute key %q uses the reserved goog prefix", k)
+		}
+		if len(k) > maxAttributeKeySize {
+			return fmt.Errorf("xk6-pubsub: attribute key %q exceeds the limit of %d bytes", k, maxAttributeKeySize)
+		}
+		if len(v) > maxAttributeValueSize {
+			return fmt.Errorf("xk6-pubsub: value of attribute %q exceeds the limit of %d bytes", k, maxAttributeValueSize)
+		}
+	}
+
+	return nil
+}
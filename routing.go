@@ -0,0 +1,54 @@
+package pubsub
+
+import (
+	"sort"
+	"strings"
+)
+
+// RoutingTable maps attribute key prefixes to subscription IDs for
+// content-based routing tests.
+type RoutingTable struct {
+	prefixes []string
+	routes   map[string]string
+}
+
+// CreateRoutingTable creates a RoutingTable from routes, a map of attribute
+// key prefixes to subscription IDs.
+func (ps *PubSub) CreateRoutingTable(routes map[string]string) *RoutingTable {
+	table := &RoutingTable{
+		prefixes: make([]string, 0, len(routes)),
+		routes:   make(map[string]string, len(routes)),
+	}
+
+	for prefix, subscriptionID := range routes {
+		table.prefixes = append(table.prefixes, prefix)
+		table.routes[prefix] = subscriptionID
+	}
+
+	// Longer prefixes are more specific, so they are matched first. Prefixes
+	// of the same length are matched alphabetically to keep Route deterministic.
+	sort.Slice(table.prefixes, func(i, j int) bool {
+		a, b := table.prefixes[i], table.prefixes[j]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+
+	return table
+}
+
+// Route returns the subscription ID of the first prefix matching any of the
+// attribute keys. Prefixes are tried from the longest to the shortest. An
+// empty string is returned when no prefix matches.
+func (t *RoutingTable) Route(attributes map[string]string) string {
+	for _, prefix := range t.prefixes {
+		for key := range attributes {
+			if strings.HasPrefix(key, prefix) {
+				return t.routes[prefix]
+			}
+		}
+	}
+
+	return ""
+}